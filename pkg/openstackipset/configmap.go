@@ -16,40 +16,124 @@ limitations under the License.
 package openstackipset
 
 import (
+	"crypto/sha1"
 	"fmt"
 	"net"
 
-	"strconv"
 	"strings"
 
+	netutils "k8s.io/utils/net"
+
 	ospdirectorv1beta1 "github.com/openstack-k8s-operators/osp-director-operator/api/v1beta1"
-	common "github.com/openstack-k8s-operators/osp-director-operator/pkg/common"
 )
 
-type networkType struct {
+// IPv4Family / IPv6Family - identifiers used to key a dual-stack subnet or
+// address pair by address family
+const (
+	IPv4Family = "IPv4"
+	IPv6Family = "IPv6"
+)
+
+// subnetType - a single IPv4 or IPv6 subnet of a (possibly dual-stack)
+// OpenStackNet
+type subnetType struct {
 	Name            string
-	NameLower       string
 	Cidr            string // e.g. 192.168.24.0/24
 	NetAddr         string // e.g. 192.168.24.0
 	CidrSuffix      int    // e.g. 24
-	MTU             int
 	AllocationStart string
 	AllocationEnd   string
 	Gateway         string
 	Vlan            int
+	IPVersion       string // IPv4Family or IPv6Family
 }
 
-// information to build NodePortMap entry:
-//   ip_address: 192.168.24.9 (2001:DB8:24::9)
-//   ip_subnet: 192.168.24.9/24 (2001:DB8:24::9/64)
-//   ip_address_uri: 192.168.24.9 ([2001:DB8:24::9])
-type ipType struct {
+type networkType struct {
+	Name      string
+	NameLower string
+	MTU       int
+	// Subnets holds one subnetType per subnet defined on the OpenStackNet,
+	// keyed by subnet name. A dual-stack network carries both an IPv4 and
+	// an IPv6 entry.
+	Subnets map[string]*subnetType
+}
+
+// ipDetailType - information to build a NodePortMap entry for a single
+// address family:
+//
+//	ip_address: 192.168.24.9 (2001:DB8:24::9)
+//	ip_subnet: 192.168.24.9/24 (2001:DB8:24::9/64)
+//	ip_address_uri: 192.168.24.9 ([2001:DB8:24::9])
+type ipDetailType struct {
 	IPaddr       string // e.g. 192.168.24.9
-	IPAddrURI    string // e.g. 192.168.24.9
+	IPAddrURI    string // e.g. 192.168.24.9 or [2001:DB8:24::9]
 	IPAddrSubnet string // e.g. 192.168.24.9/24
 	Subnet       string // e.g. 192.168.24.0/24
 }
 
+// ipType - the IPv4 and/or IPv6 address details for a node on a given
+// network. A single-stack network only populates the matching family.
+type ipType struct {
+	IPv4 *ipDetailType
+	IPv6 *ipDetailType
+}
+
+// AddressPair - an allowed_address_pairs entry on a Neutron port, letting a
+// keepalived VIP float onto a node's port
+type AddressPair struct {
+	IP  string
+	MAC string
+}
+
+// portType - Neutron port attributes for a node's port on a given network.
+// AdminStateUp is sourced from OpenStackNet.Spec.PortOpts, MACAddress (when
+// set) from OpenStackNet.Spec.PortOpts.MACMapping keyed by hostname (ports
+// can't share a MAC, so this can't be a single network-wide value), and
+// AllowedAddressPairs from VIP reservations on the same role/network.
+type portType struct {
+	AllowedAddressPairs []AddressPair
+	AdminStateUp        *bool
+	MACAddress          string
+}
+
+// ovnChassisType - one OVN localnet chassis-redirect port for a role/node on
+// a network flagged Spec.OVNLocalnet, modeling the node-switch-port + SNAT
+// approach used by ovn4nfv-k8s-plugin so an edge/DCN role can egress traffic
+// through a per-node OVS internal port and logical_router_policy SNAT rule
+// instead of routing back through a central gateway.
+type ovnChassisType struct {
+	LocalnetPortName string // SHA1(hostname+network)[:15]; OVS internal port names are capped at 15 chars
+	ChassisName      string
+	SnatSourceCIDR   string
+	SnatExternalIP   string
+}
+
+// localnetPortName derives the stable, 15-char-max OVS internal port name
+// for a node's localnet chassis-redirect port on a given network.
+func localnetPortName(hostname, osnetName string) string {
+	sum := sha1.Sum([]byte(hostname + osnetName))
+	return fmt.Sprintf("%x", sum)[:15]
+}
+
+// defaultMTU - applied when OpenStackNet.Spec.MTU is unset
+const defaultMTU = 1500
+
+// mtu returns the network's configured MTU, falling back to defaultMTU
+func mtu(specMTU int) int {
+	if specMTU == 0 {
+		return defaultMTU
+	}
+	return specMTU
+}
+
+// trunkType - a Neutron VLAN trunk parent/subport relationship, binding a
+// child OpenStackNet to a VLAN segment of a parent network
+type trunkType struct {
+	ParentNetwork  string
+	SegmentationID int
+	ChildNetwork   string
+}
+
 type roleType struct {
 	Name      string
 	NameLower string
@@ -60,23 +144,122 @@ type roleType struct {
 type nodeType struct {
 	Index                   int
 	IPaddr                  map[string]*ipType
+	Ports                   map[string]*portType
 	Hostname                string
 	VIP                     bool
 	OVNStaticBridgeMappings map[string]string
 }
 
-func getCidrParts(cidr string) (string, int, error) {
-	cidrPieces := strings.Split(cidr, "/")
-	cidrSuffix, err := strconv.Atoi(cidrPieces[len(cidrPieces)-1])
+// buildSubnet turns an OpenStackNetSubnet spec entry into a subnetType,
+// deriving NetAddr/CidrSuffix/IPVersion from the CIDR itself so that both
+// IPv4 and IPv6 prefixes are handled correctly.
+func buildSubnet(name string, subnetSpec ospdirectorv1beta1.OpenStackNetSubnetSpec) (*subnetType, error) {
+	netAddr, ipNet, err := net.ParseCIDR(subnetSpec.Cidr)
 	if err != nil {
-		return "", cidrSuffix, err
+		return nil, err
+	}
+	cidrSuffix, _ := ipNet.Mask.Size()
+
+	ipVersion := IPv4Family
+	if netutils.IsIPv6CIDRString(subnetSpec.Cidr) {
+		ipVersion = IPv6Family
+	}
+
+	return &subnetType{
+		Name:            name,
+		Cidr:            subnetSpec.Cidr,
+		NetAddr:         netAddr.String(),
+		CidrSuffix:      cidrSuffix,
+		AllocationStart: subnetSpec.AllocationStart,
+		AllocationEnd:   subnetSpec.AllocationEnd,
+		Gateway:         subnetSpec.Gateway,
+		Vlan:            subnetSpec.Vlan,
+		IPVersion:       ipVersion,
+	}, nil
+}
+
+// claimedSubnetPoolCIDRs collects the CIDRs already claimed by sibling
+// OpenStackNet subnets carved from the same Spec.SubnetPool, so that carving
+// a new subnet for (osnetName, subnetName) doesn't overlap them.
+func claimedSubnetPoolCIDRs(netList ospdirectorv1beta1.OpenStackNetList, pool, osnetName, subnetName string) []string {
+	var claimed []string
+	for _, sibling := range netList.Items {
+		for name, spec := range sibling.Spec.Subnets {
+			if sibling.Name == osnetName && name == subnetName {
+				continue
+			}
+			if spec.SubnetPool.Cidr != pool {
+				continue
+			}
+			if status, ok := sibling.Status.Subnets[name]; ok && status.AllocatedCidr != "" {
+				claimed = append(claimed, status.AllocatedCidr)
+			} else if spec.Cidr != "" {
+				claimed = append(claimed, spec.Cidr)
+			}
+		}
+	}
+	return claimed
+}
+
+// buildIPDetail renders the ip_address/ip_address_uri/ip_subnet triple for
+// a single reservation IP against the subnet it was allocated from.
+func buildIPDetail(ip string, subnet *subnetType) *ipDetailType {
+	uri := ip
+	if netutils.IsIPv6String(ip) {
+		// IP address with brackets in case of IPv6, e.g. [2001:DB8:24::15]
+		uri = fmt.Sprintf("[%s]", ip)
+	}
+
+	return &ipDetailType{
+		IPaddr:       ip,
+		IPAddrURI:    uri,
+		IPAddrSubnet: fmt.Sprintf("%s/%d", ip, subnet.CidrSuffix),
+		Subnet:       subnet.Cidr,
+	}
+}
+
+// snatSourceCIDR derives the CIDR the SNAT egress rule should match from a
+// network's AllocationStart..AllocationEnd range (not its whole subnet, which
+// would also match the gateway, VIPs and unallocated addresses), preferring
+// the IPv4 subnet when the network is dual-stack.
+func snatSourceCIDR(network *networkType) (string, error) {
+	var fallback *subnetType
+	for _, subnet := range network.Subnets {
+		if subnet.IPVersion == IPv4Family {
+			return RangeToCIDR(subnet.AllocationStart, subnet.AllocationEnd)
+		}
+		fallback = subnet
+	}
+	if fallback != nil {
+		return RangeToCIDR(fallback.AllocationStart, fallback.AllocationEnd)
 	}
+	return "", nil
+}
 
-	return cidrPieces[0], cidrSuffix, nil
+// AllocatedSubnet identifies a subnet freshly carved from an
+// OpenStackNet.Spec.SubnetPool during this call. The caller MUST persist
+// Cidr into that OpenStackNet's Status.Subnets[SubnetName].AllocatedCidr
+// before the next reconcile - otherwise CreateConfigMapParams has no record
+// of the choice and will carve a (possibly different) CIDR again next time.
+type AllocatedSubnet struct {
+	NetworkName string
+	SubnetName  string
+	Cidr        string
 }
 
-// CreateConfigMapParams - creates a map of parameters for the overcloud ipset config map
-func CreateConfigMapParams(overcloudNetList ospdirectorv1beta1.OpenStackNetList, overcloudMACList ospdirectorv1beta1.OpenStackMACAddressList) (map[string]interface{}, error) {
+// CreateConfigMapParams - creates a map of parameters for the overcloud ipset config map.
+// netNameMap is the OpenStackNetConfig-owned registry of network names, keyed by the
+// CR-safe OpenStackNet name (osnet.Name), that supplies the CamelCase template name and
+// lower-case TripleO service alias for each network, including operator-defined
+// custom_networks.
+// The returned []AllocatedSubnet lists any Spec.SubnetPool subnets that were carved for
+// the first time in this call (i.e. had no Status.Subnets[name].AllocatedCidr yet); the
+// caller is responsible for persisting each one to Status before the next reconcile.
+func CreateConfigMapParams(
+	overcloudNetList ospdirectorv1beta1.OpenStackNetList,
+	overcloudMACList ospdirectorv1beta1.OpenStackMACAddressList,
+	netNameMap map[string]NetNameMap,
+) (map[string]interface{}, []AllocatedSubnet, error) {
 
 	templateParameters := make(map[string]interface{})
 
@@ -88,37 +271,99 @@ func CreateConfigMapParams(overcloudNetList ospdirectorv1beta1.OpenStackNetList,
 	// map with details for all networks
 	networksMap := map[string]*networkType{}
 	rolesMap := map[string]*roleType{}
-	var osnetName string
+	// ovnChassisMap carries the OVN localnet chassis-redirect ports that edge/DCN
+	// roles need, keyed by role name, then network name, then node hostname
+	ovnChassisMap := map[string]map[string]map[string]*ovnChassisType{}
+	// trunkMap carries the VLAN trunk parent/subport relationships a role's
+	// networks participate in, keyed by role name, then child network name
+	trunkMap := map[string]map[string]*trunkType{}
+	// freshlyAllocatedCidrs tracks subnets carved from a Spec.SubnetPool
+	// earlier in this same call, keyed by pool CIDR, so that two sibling
+	// OpenStackNets needing a first-time allocation from the same pool in
+	// one pass don't get handed overlapping subnets
+	freshlyAllocatedCidrs := map[string][]string{}
+	// allocatedSubnets is returned to the caller so it can persist each
+	// freshly-carved CIDR into Status.Subnets[name].AllocatedCidr
+	var allocatedSubnets []AllocatedSubnet
 
 	for _, osnet := range overcloudNetList.Items {
 
-		// CR names won't allow '_', need to change tripleo nets using those
-		switch osnet.Name {
-		case "internalapi":
-			osnetName = InternalAPIName
-		case "storagemgmt":
-			osnetName = StorageMgmtName
-		default:
-			osnetName = osnet.Name
-		}
+		// osnet.Name is already CR-safe; the registry supplies the CamelCase
+		// template name and lower-case TripleO alias for it, including any
+		// operator-defined custom_networks entries
+		osnetName := osnet.Name
 
-		// create map of all network
+		// create map of all networks, each carrying one subnetType per
+		// subnet defined on the OpenStackNet (dual-stack nets carry an IPv4
+		// and an IPv6 one)
 		if networksMap[osnetName] == nil {
-			netAddr, cidrSuffix, err := getCidrParts(osnet.Spec.Cidr)
-			if err != nil {
-				return templateParameters, err
+			subnets := map[string]*subnetType{}
+			for subnetName, subnetSpec := range osnet.Spec.Subnets {
+				// a Spec.SubnetPool carves this subnet's Cidr/AllocationStart/
+				// AllocationEnd from a larger pool instead of taking them as
+				// given; Status.AllocatedCidr makes the carve idempotent
+				// across reconciles
+				if subnetSpec.SubnetPool.Cidr != "" {
+					pool := subnetSpec.SubnetPool.Cidr
+					claimed := append(
+						claimedSubnetPoolCIDRs(overcloudNetList, pool, osnetName, subnetName),
+						freshlyAllocatedCidrs[pool]...,
+					)
+					existing := osnet.Status.Subnets[subnetName].AllocatedCidr
+
+					cidr, allocationStart, allocationEnd, err := ResolveSubnetPool(subnetSpec.SubnetPool, existing, claimed)
+					if err != nil {
+						return templateParameters, allocatedSubnets, err
+					}
+
+					if existing == "" {
+						freshlyAllocatedCidrs[pool] = append(freshlyAllocatedCidrs[pool], cidr)
+						allocatedSubnets = append(allocatedSubnets, AllocatedSubnet{
+							NetworkName: osnetName,
+							SubnetName:  subnetName,
+							Cidr:        cidr,
+						})
+					}
+
+					subnetSpec.Cidr = cidr
+					subnetSpec.AllocationStart = allocationStart
+					subnetSpec.AllocationEnd = allocationEnd
+				}
+
+				subnet, err := buildSubnet(subnetName, subnetSpec)
+				if err != nil {
+					return templateParameters, allocatedSubnets, err
+				}
+				subnets[subnetName] = subnet
 			}
+
 			networksMap[osnetName] = &networkType{
-				Name:            GetNetName(osnetName),
-				NameLower:       osnetName,
-				Cidr:            osnet.Spec.Cidr,
-				CidrSuffix:      cidrSuffix,
-				NetAddr:         netAddr,
-				MTU:             1500, //TODO custom MTU per network
-				AllocationStart: osnet.Spec.AllocationStart,
-				AllocationEnd:   osnet.Spec.AllocationEnd,
-				Gateway:         osnet.Spec.Gateway,
-				Vlan:            osnet.Spec.Vlan,
+				Name:      GetNetName(netNameMap, osnetName),
+				NameLower: GetNetNameLower(netNameMap, osnetName),
+				MTU:       mtu(osnet.Spec.MTU),
+				Subnets:   subnets,
+			}
+		}
+
+		if osnet.Spec.Trunk.ParentNetwork != "" {
+			for roleName, roleReservation := range osnet.Status.RoleReservations {
+				// same gate as RolesMap/IPaddr/ovnChassisMap below, so TrunkMap
+				// doesn't carry entries for roles absent from the rest of the
+				// rendered config map
+				if !roleReservation.AddToPredictableIPs {
+					continue
+				}
+
+				if trunkMap[roleName] == nil {
+					trunkMap[roleName] = map[string]*trunkType{}
+				}
+				// keyed by child network, not parent, since multiple child
+				// networks can be trunked as subports onto the same parent
+				trunkMap[roleName][osnetName] = &trunkType{
+					ParentNetwork:  osnet.Spec.Trunk.ParentNetwork,
+					SegmentationID: osnet.Spec.Trunk.SegmentationID,
+					ChildNetwork:   osnetName,
+				}
 			}
 		}
 
@@ -162,61 +407,151 @@ func CreateConfigMapParams(overcloudNetList ospdirectorv1beta1.OpenStackNetList,
 						rolesMap[roleName].Nodes[reservation.Hostname] = &nodeType{
 							Index:                   hostnameMapIndex,
 							IPaddr:                  map[string]*ipType{},
+							Ports:                   map[string]*portType{},
 							Hostname:                reservation.Hostname,
 							VIP:                     reservation.VIP,
 							OVNStaticBridgeMappings: ovnStaticBridgeMappings,
 						}
 					}
 
-					uri := reservation.IP
-					if common.IsIPv6(net.ParseIP(reservation.IP)) {
-						// IP address with brackets in case of IPv6, e.g. [2001:DB8:24::15]
-						uri = fmt.Sprintf("[%s]", uri)
-					}
 					if rolesMap[roleName].Nodes[reservation.Hostname].IPaddr[osnetName] == nil {
-						rolesMap[roleName].Nodes[reservation.Hostname].IPaddr[osnetName] = &ipType{
-							IPaddr:       reservation.IP,
-							IPAddrURI:    uri,
-							IPAddrSubnet: fmt.Sprintf("%s/%d", reservation.IP, networksMap[osnetName].CidrSuffix),
-							Subnet:       networksMap[osnetName].Cidr,
+						rolesMap[roleName].Nodes[reservation.Hostname].IPaddr[osnetName] = &ipType{}
+					}
+					node := rolesMap[roleName].Nodes[reservation.Hostname]
+
+					// reservation.IPs carries one address per subnet name,
+					// e.g. {"ctlplane": "192.168.24.9", "ctlplane_v6": "2001:DB8:24::9"};
+					// VIP reservations are expected to only ever resolve
+					// against the subnet matching their own family so that
+					// keepalived groups stay split per family.
+					for subnetName, ip := range reservation.IPs {
+						subnet := networksMap[osnetName].Subnets[subnetName]
+						if subnet == nil {
+							continue
+						}
+
+						detail := buildIPDetail(ip, subnet)
+						if subnet.IPVersion == IPv6Family {
+							node.IPaddr[osnetName].IPv6 = detail
+						} else {
+							node.IPaddr[osnetName].IPv4 = detail
 						}
 					}
+
+					if node.Ports[osnetName] == nil {
+						node.Ports[osnetName] = &portType{
+							AdminStateUp: osnet.Spec.PortOpts.AdminStateUp,
+							MACAddress:   osnet.Spec.PortOpts.MACMapping[reservation.Hostname],
+						}
+					}
+
+					// only edge/DCN roles on networks flagged for OVN localnet
+					// get a chassis-redirect port + SNAT entry
+					if osnet.Spec.OVNLocalnet && roleReservation.EdgeChassis {
+						if ovnChassisMap[roleName] == nil {
+							ovnChassisMap[roleName] = map[string]map[string]*ovnChassisType{}
+						}
+						if ovnChassisMap[roleName][osnetName] == nil {
+							ovnChassisMap[roleName][osnetName] = map[string]*ovnChassisType{}
+						}
+
+						snatCIDR, err := snatSourceCIDR(networksMap[osnetName])
+						if err != nil {
+							return templateParameters, allocatedSubnets, err
+						}
+
+						ovnChassisMap[roleName][osnetName][reservation.Hostname] = &ovnChassisType{
+							LocalnetPortName: localnetPortName(reservation.Hostname, osnetName),
+							ChassisName:      reservation.Hostname,
+							SnatSourceCIDR:   snatCIDR,
+							SnatExternalIP:   osnet.Spec.SNAT.ExternalIP,
+						}
+					}
+
 					hostnameMapIndex++
 				}
 			}
+
+			// push every VIP's address onto the allowed_address_pairs of
+			// every non-VIP port in the same role/network, so a keepalived
+			// VIP can float onto a node's port
+			var vipPairs []AddressPair
+			for _, vipNode := range rolesMap[roleName].Nodes {
+				if !vipNode.VIP {
+					continue
+				}
+				if vipIP, ok := vipNode.IPaddr[osnetName]; ok {
+					if vipIP.IPv4 != nil {
+						vipPairs = append(vipPairs, AddressPair{IP: vipIP.IPv4.IPaddr, MAC: vipNode.Ports[osnetName].MACAddress})
+					}
+					if vipIP.IPv6 != nil {
+						vipPairs = append(vipPairs, AddressPair{IP: vipIP.IPv6.IPaddr, MAC: vipNode.Ports[osnetName].MACAddress})
+					}
+				}
+			}
+
+			for _, node := range rolesMap[roleName].Nodes {
+				if node.VIP || node.Ports[osnetName] == nil {
+					continue
+				}
+				node.Ports[osnetName].AllowedAddressPairs = vipPairs
+			}
 		}
 	}
 
 	templateParameters["RolesMap"] = rolesMap
 	templateParameters["NetworksMap"] = networksMap
+	templateParameters["NetworkNameMap"] = netNameMap
+	templateParameters["OVNChassisMap"] = ovnChassisMap
+	templateParameters["TrunkMap"] = trunkMap
 
-	return templateParameters, nil
+	return templateParameters, allocatedSubnets, nil
 
 }
 
-// GetNetNameLower -
-func GetNetNameLower(net string) string {
-	return strings.ToLower(networkDict()(net))
+// NetNameMap - a single network's naming triple, as owned by the
+// OpenStackNetConfig that defines the overcloud's networks (built-in TripleO
+// nets and operator-defined custom_networks alike):
+//   - Name is the CamelCase name used in rendered templates, e.g. InternalApi
+//   - NameLower is the lower-case TripleO service alias, e.g. internal_api
+//   - NameCRSafe is the name as it appears on the OpenStackNet CR, e.g. internalapi
+//
+// This replaces the previous hardcoded networkDict/switch so operator-defined
+// networks (e.g. ceph_cluster, octavia_mgmt) are treated the same as the
+// built-in ones.
+type NetNameMap struct {
+	Name       string
+	NameLower  string
+	NameCRSafe string
 }
 
-// GetNetName -
-func GetNetName(net string) string {
-	return networkDict()(net)
+// GetNetNameLower - looks up the lower-case TripleO service alias for a
+// network by its CR-safe name in the given registry
+func GetNetNameLower(netNameMap map[string]NetNameMap, osnetName string) string {
+	return netNameMap[osnetName].NameLower
 }
 
-func networkDict() func(string) string {
-	// innerMap is captured in the closure returned below
-	innerMap := map[string]string{
-		"ctlplane":     "Control",
-		"internal_api": "InternalApi",
-		"external":     "External",
-		"storage":      "Storage",
-		"storage_mgmt": "StorageMgmt",
-		"tenant":       "Tenant",
-		"management":   "Management",
-	}
+// GetNetName - looks up the CamelCase template name for a network by its
+// CR-safe name in the given registry
+func GetNetName(netNameMap map[string]NetNameMap, osnetName string) string {
+	return netNameMap[osnetName].Name
+}
 
-	return func(key string) string {
-		return innerMap[key]
+// ValidateNetNameMapUniqueness checks that no two OpenStackNets in the
+// registry resolve to the same CamelCase Name: NetworksMap/NetworkNameMap are
+// keyed by the CR-safe name, so two colliding custom_networks would otherwise
+// both be rendered under the same template name. This is the uniqueness check itself; wiring it into a
+// ValidatingWebhookConfiguration is a controller/API-layer concern that
+// doesn't live in this package, so it's exposed here for an
+// OpenStackNet/OpenStackNetConfig webhook to call from its validate-create/
+// validate-update handlers.
+func ValidateNetNameMapUniqueness(netNameMap map[string]NetNameMap) error {
+	seen := make(map[string]string, len(netNameMap))
+	for osnetName, entry := range netNameMap {
+		if conflict, ok := seen[entry.Name]; ok {
+			return fmt.Errorf("network name %q is used by both %q and %q", entry.Name, conflict, osnetName)
+		}
+		seen[entry.Name] = osnetName
 	}
+	return nil
 }
@@ -0,0 +1,188 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstackipset
+
+import "testing"
+
+func TestMTU(t *testing.T) {
+	tests := []struct {
+		name    string
+		specMTU int
+		want    int
+	}{
+		{name: "unset falls back to the default", specMTU: 0, want: defaultMTU},
+		{name: "explicit value is passed through", specMTU: 9000, want: 9000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mtu(tt.specMTU); got != tt.want {
+				t.Errorf("mtu(%d) = %d, want %d", tt.specMTU, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalnetPortName(t *testing.T) {
+	got := localnetPortName("compute-0", "internalapi")
+	if len(got) != 15 {
+		t.Fatalf("localnetPortName() = %q, want a 15-character OVS port name", got)
+	}
+
+	// deterministic: the same (hostname, network) pair always renders the
+	// same port name, so OVN chassis-redirect ports survive reconciles
+	again := localnetPortName("compute-0", "internalapi")
+	if got != again {
+		t.Errorf("localnetPortName() is not deterministic: %q != %q", got, again)
+	}
+
+	// distinct inputs must not collide
+	other := localnetPortName("compute-1", "internalapi")
+	if got == other {
+		t.Errorf("localnetPortName() returned the same name for different hostnames: %q", got)
+	}
+}
+
+func TestBuildIPDetail(t *testing.T) {
+	tests := []struct {
+		name   string
+		ip     string
+		subnet *subnetType
+		want   ipDetailType
+	}{
+		{
+			name:   "IPv4 address is rendered without brackets",
+			ip:     "192.168.24.9",
+			subnet: &subnetType{Cidr: "192.168.24.0/24", CidrSuffix: 24},
+			want: ipDetailType{
+				IPaddr:       "192.168.24.9",
+				IPAddrURI:    "192.168.24.9",
+				IPAddrSubnet: "192.168.24.9/24",
+				Subnet:       "192.168.24.0/24",
+			},
+		},
+		{
+			name:   "IPv6 address is bracketed for the URI form",
+			ip:     "2001:db8:24::9",
+			subnet: &subnetType{Cidr: "2001:db8:24::/64", CidrSuffix: 64},
+			want: ipDetailType{
+				IPaddr:       "2001:db8:24::9",
+				IPAddrURI:    "[2001:db8:24::9]",
+				IPAddrSubnet: "2001:db8:24::9/64",
+				Subnet:       "2001:db8:24::/64",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildIPDetail(tt.ip, tt.subnet)
+			if *got != tt.want {
+				t.Errorf("buildIPDetail(%q, ...) = %+v, want %+v", tt.ip, *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateNetNameMapUniqueness(t *testing.T) {
+	tests := []struct {
+		name       string
+		netNameMap map[string]NetNameMap
+		wantErr    bool
+	}{
+		{
+			name: "distinct CamelCase names are fine",
+			netNameMap: map[string]NetNameMap{
+				"internalapi": {Name: "InternalApi"},
+				"storagemgmt": {Name: "StorageMgmt"},
+			},
+		},
+		{
+			name: "two custom networks colliding on CamelCase name is rejected",
+			netNameMap: map[string]NetNameMap{
+				"ceph-cluster": {Name: "CephCluster"},
+				"ceph_cluster": {Name: "CephCluster"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateNetNameMapUniqueness(tt.netNameMap)
+			if tt.wantErr && err == nil {
+				t.Fatalf("ValidateNetNameMapUniqueness(%+v) = nil, want error", tt.netNameMap)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("ValidateNetNameMapUniqueness(%+v) returned unexpected error: %v", tt.netNameMap, err)
+			}
+		})
+	}
+}
+
+func TestSnatSourceCIDR(t *testing.T) {
+	tests := []struct {
+		name    string
+		network *networkType
+		want    string
+	}{
+		{
+			name: "single-stack IPv4 derives from the allocation range, not the whole subnet",
+			network: &networkType{
+				Subnets: map[string]*subnetType{
+					"subnet1": {IPVersion: IPv4Family, AllocationStart: "192.168.24.2", AllocationEnd: "192.168.24.254"},
+				},
+			},
+			want: "192.168.24.0/24",
+		},
+		{
+			name: "dual-stack prefers the IPv4 subnet over the IPv6 fallback",
+			network: &networkType{
+				Subnets: map[string]*subnetType{
+					"subnet6": {IPVersion: IPv6Family, AllocationStart: "2001:db8:24::2", AllocationEnd: "2001:db8:24::ff"},
+					"subnet4": {IPVersion: IPv4Family, AllocationStart: "192.168.24.2", AllocationEnd: "192.168.24.254"},
+				},
+			},
+			want: "192.168.24.0/24",
+		},
+		{
+			name: "IPv6-only network falls back to the v6 subnet",
+			network: &networkType{
+				Subnets: map[string]*subnetType{
+					"subnet6": {IPVersion: IPv6Family, AllocationStart: "2001:db8:24::2", AllocationEnd: "2001:db8:24::ff"},
+				},
+			},
+			want: "2001:db8:24::/120",
+		},
+		{
+			name:    "network with no subnets yields an empty CIDR",
+			network: &networkType{Subnets: map[string]*subnetType{}},
+			want:    "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := snatSourceCIDR(tt.network)
+			if err != nil {
+				t.Fatalf("snatSourceCIDR() returned unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("snatSourceCIDR() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
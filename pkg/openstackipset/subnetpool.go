@@ -0,0 +1,203 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstackipset
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+
+	ospdirectorv1beta1 "github.com/openstack-k8s-operators/osp-director-operator/api/v1beta1"
+)
+
+// AllocateSubnetCIDR finds the lowest unused /prefixLength subnet within pool
+// that doesn't overlap any of claimed (CIDRs already allocated to sibling
+// OpenStackNets sharing the same Spec.SubnetPool), using a deterministic
+// first-fit scan similar to podman's pkg/network/subnet allocator. The
+// caller is expected to persist the chosen CIDR into the OpenStackNet's
+// Status.Subnets[name].AllocatedCidr so that later reconciles are idempotent and reuse it
+// instead of calling this again.
+func AllocateSubnetCIDR(pool string, prefixLength int, claimed []string) (string, error) {
+	_, poolNet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return "", err
+	}
+
+	ones, bits := poolNet.Mask.Size()
+	if prefixLength < ones || prefixLength > bits {
+		return "", fmt.Errorf("prefix length /%d is out of range for pool %s", prefixLength, pool)
+	}
+
+	claimedNets := make([]*net.IPNet, 0, len(claimed))
+	for _, c := range claimed {
+		_, cn, err := net.ParseCIDR(c)
+		if err != nil {
+			return "", err
+		}
+		claimedNets = append(claimedNets, cn)
+	}
+
+	candidateIP := poolNet.IP.Mask(net.CIDRMask(prefixLength, bits))
+	for poolNet.Contains(candidateIP) {
+		candidate := &net.IPNet{IP: candidateIP, Mask: net.CIDRMask(prefixLength, bits)}
+
+		if !overlapsAny(candidate, claimedNets) {
+			return candidate.String(), nil
+		}
+
+		next, overflowed := nextSubnetIP(candidate.IP, prefixLength, bits)
+		if overflowed {
+			break
+		}
+		candidateIP = next
+	}
+
+	return "", fmt.Errorf("no free /%d subnet available in pool %s", prefixLength, pool)
+}
+
+func overlapsAny(candidate *net.IPNet, others []*net.IPNet) bool {
+	for _, other := range others {
+		if candidate.Contains(other.IP) || other.Contains(candidate.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextSubnetIP returns the network address of the subnet immediately
+// following the one starting at ip, by adding one subnet-sized block.
+// overflowed is true if that address space runs past the top of the address
+// family (e.g. past 255.255.255.255), in which case the returned IP is invalid.
+func nextSubnetIP(ip net.IP, prefixLength, bits int) (next net.IP, overflowed bool) {
+	size := len(ip)
+	if v4 := ip.To4(); v4 != nil {
+		size = len(v4)
+	}
+
+	blockSize := new(big.Int).Lsh(big.NewInt(1), uint(bits-prefixLength))
+	nextInt := new(big.Int).SetBytes(ip.To16())
+	if v4 := ip.To4(); v4 != nil {
+		nextInt = new(big.Int).SetBytes(v4)
+	}
+	nextInt.Add(nextInt, blockSize)
+
+	out := nextInt.Bytes()
+	if len(out) > size {
+		return nil, true
+	}
+
+	buf := make(net.IP, size)
+	copy(buf[size-len(out):], out)
+	return buf, false
+}
+
+// DeriveAllocationRange computes the default AllocationStart/AllocationEnd
+// pair for a carved subnet as netaddr+2 (skipping the network address and
+// the gateway at netaddr+1) through broadcast-1.
+func DeriveAllocationRange(cidr string) (start string, end string, err error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", "", err
+	}
+
+	netAddr := new(big.Int).SetBytes(ipNet.IP.To16())
+	if v4 := ipNet.IP.To4(); v4 != nil {
+		netAddr = new(big.Int).SetBytes(v4)
+	}
+
+	ones, bits := ipNet.Mask.Size()
+	hostBits := bits - ones
+	blockSize := new(big.Int).Lsh(big.NewInt(1), uint(hostBits))
+	broadcast := new(big.Int).Add(netAddr, blockSize)
+	broadcast.Sub(broadcast, big.NewInt(1))
+
+	startInt := new(big.Int).Add(netAddr, big.NewInt(2))
+	endInt := new(big.Int).Sub(broadcast, big.NewInt(1))
+
+	if startInt.Cmp(endInt) > 0 {
+		return "", "", fmt.Errorf("subnet %s is too small to carve an allocation range", cidr)
+	}
+
+	return bigIntToIP(startInt, ipNet.IP).String(), bigIntToIP(endInt, ipNet.IP).String(), nil
+}
+
+// ResolveSubnetPool finalizes the Cidr/AllocationStart/AllocationEnd for a
+// subnet carved from Spec.SubnetPool. If existingAllocatedCidr (the subnet's
+// persisted Status.AllocatedCidr) is already set, it is reused unchanged so
+// that reconciles are idempotent; otherwise a new non-overlapping CIDR is
+// carved from the pool via AllocateSubnetCIDR. The returned cidr must be
+// persisted back into Status.AllocatedCidr by the caller.
+func ResolveSubnetPool(pool ospdirectorv1beta1.OpenStackNetSubnetPool, existingAllocatedCidr string, claimed []string) (cidr, allocationStart, allocationEnd string, err error) {
+	cidr = existingAllocatedCidr
+	if cidr == "" {
+		cidr, err = AllocateSubnetCIDR(pool.Cidr, pool.PrefixLength, claimed)
+		if err != nil {
+			return "", "", "", err
+		}
+	}
+
+	allocationStart, allocationEnd, err = DeriveAllocationRange(cidr)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return cidr, allocationStart, allocationEnd, nil
+}
+
+// RangeToCIDR returns the smallest CIDR block that covers both startStr and
+// endStr, found by masking off the bits the two addresses disagree on. The
+// returned block may include a few addresses outside [start, end] when the
+// range isn't itself aligned to a power-of-two boundary, which is
+// acceptable for a SNAT match rule (it only ever widens the match, never
+// narrows it below the allocated range).
+func RangeToCIDR(startStr, endStr string) (string, error) {
+	start := net.ParseIP(startStr)
+	end := net.ParseIP(endStr)
+	if start == nil || end == nil {
+		return "", fmt.Errorf("invalid allocation range %s-%s", startStr, endStr)
+	}
+
+	size := 16
+	sBytes := start.To16()
+	eBytes := end.To16()
+	if v4s, v4e := start.To4(), end.To4(); v4s != nil && v4e != nil {
+		size = 4
+		sBytes = v4s
+		eBytes = v4e
+	}
+	bits := size * 8
+
+	sInt := new(big.Int).SetBytes(sBytes)
+	eInt := new(big.Int).SetBytes(eBytes)
+
+	diff := new(big.Int).Xor(sInt, eInt)
+	prefixLength := bits - diff.BitLen()
+
+	netInt := new(big.Int).And(sInt, new(big.Int).Lsh(big.NewInt(-1), uint(bits-prefixLength)))
+
+	return fmt.Sprintf("%s/%d", bigIntToIP(netInt, start).String(), prefixLength), nil
+}
+
+func bigIntToIP(i *big.Int, like net.IP) net.IP {
+	out := i.Bytes()
+	size := len(like.To16())
+	if v4 := like.To4(); v4 != nil {
+		size = len(v4)
+	}
+	buf := make(net.IP, size)
+	copy(buf[size-len(out):], out)
+	return buf
+}
@@ -0,0 +1,194 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstackipset
+
+import (
+	"testing"
+
+	ospdirectorv1beta1 "github.com/openstack-k8s-operators/osp-director-operator/api/v1beta1"
+)
+
+func TestAllocateSubnetCIDR(t *testing.T) {
+	tests := []struct {
+		name         string
+		pool         string
+		prefixLength int
+		claimed      []string
+		want         string
+		wantErr      bool
+	}{
+		{
+			name:         "first subnet in an empty pool",
+			pool:         "192.168.0.0/16",
+			prefixLength: 24,
+			want:         "192.168.0.0/24",
+		},
+		{
+			name:         "skips claimed subnets to find the next free one",
+			pool:         "192.168.0.0/16",
+			prefixLength: 24,
+			claimed:      []string{"192.168.0.0/24", "192.168.1.0/24"},
+			want:         "192.168.2.0/24",
+		},
+		{
+			name:         "prefix shorter than the pool's own prefix is rejected",
+			pool:         "192.168.0.0/24",
+			prefixLength: 16,
+			wantErr:      true,
+		},
+		{
+			name:         "pool fully claimed has no free subnet left",
+			pool:         "192.168.0.0/23",
+			prefixLength: 24,
+			claimed:      []string{"192.168.0.0/24", "192.168.1.0/24"},
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AllocateSubnetCIDR(tt.pool, tt.prefixLength, tt.claimed)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("AllocateSubnetCIDR(%q, %d, %v) = %q, want error", tt.pool, tt.prefixLength, tt.claimed, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AllocateSubnetCIDR(%q, %d, %v) returned unexpected error: %v", tt.pool, tt.prefixLength, tt.claimed, err)
+			}
+			if got != tt.want {
+				t.Errorf("AllocateSubnetCIDR(%q, %d, %v) = %q, want %q", tt.pool, tt.prefixLength, tt.claimed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeriveAllocationRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		cidr      string
+		wantStart string
+		wantEnd   string
+		wantErr   bool
+	}{
+		{
+			name:      "/24 carves netaddr+2 through broadcast-1",
+			cidr:      "192.168.24.0/24",
+			wantStart: "192.168.24.2",
+			wantEnd:   "192.168.24.254",
+		},
+		{
+			name:    "subnet too small to hold an allocation range is rejected",
+			cidr:    "192.168.24.0/31",
+			wantErr: true,
+		},
+		{
+			name:    "host-only /32 is rejected",
+			cidr:    "192.168.24.5/32",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, err := DeriveAllocationRange(tt.cidr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("DeriveAllocationRange(%q) = (%q, %q), want error", tt.cidr, start, end)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DeriveAllocationRange(%q) returned unexpected error: %v", tt.cidr, err)
+			}
+			if start != tt.wantStart || end != tt.wantEnd {
+				t.Errorf("DeriveAllocationRange(%q) = (%q, %q), want (%q, %q)", tt.cidr, start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestRangeToCIDR(t *testing.T) {
+	tests := []struct {
+		name    string
+		start   string
+		end     string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "full /24 allocation range round-trips to the same /24",
+			start: "192.168.24.2",
+			end:   "192.168.24.254",
+			want:  "192.168.24.0/24",
+		},
+		{
+			name:  "a single address is its own /32",
+			start: "192.168.24.10",
+			end:   "192.168.24.10",
+			want:  "192.168.24.10/32",
+		},
+		{
+			name:  "IPv6 range widens to the smallest covering prefix",
+			start: "2001:db8:24::2",
+			end:   "2001:db8:24::ff",
+			want:  "2001:db8:24::/120",
+		},
+		{
+			name:    "unparsable address is an error",
+			start:   "not-an-ip",
+			end:     "192.168.24.10",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RangeToCIDR(tt.start, tt.end)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("RangeToCIDR(%q, %q) = %q, want error", tt.start, tt.end, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RangeToCIDR(%q, %q) returned unexpected error: %v", tt.start, tt.end, err)
+			}
+			if got != tt.want {
+				t.Errorf("RangeToCIDR(%q, %q) = %q, want %q", tt.start, tt.end, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveSubnetPoolReusesExistingCidr(t *testing.T) {
+	pool := ospdirectorv1beta1.OpenStackNetSubnetPool{
+		Cidr:         "192.168.0.0/16",
+		PrefixLength: 24,
+	}
+
+	cidr, start, end, err := ResolveSubnetPool(pool, "192.168.5.0/24", []string{"192.168.0.0/24"})
+	if err != nil {
+		t.Fatalf("ResolveSubnetPool returned unexpected error: %v", err)
+	}
+	if cidr != "192.168.5.0/24" {
+		t.Errorf("ResolveSubnetPool with an existing AllocatedCidr carved a new one: got %q, want %q", cidr, "192.168.5.0/24")
+	}
+	if start != "192.168.5.2" || end != "192.168.5.254" {
+		t.Errorf("ResolveSubnetPool allocation range = (%q, %q), want (%q, %q)", start, end, "192.168.5.2", "192.168.5.254")
+	}
+}